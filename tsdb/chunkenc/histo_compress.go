@@ -0,0 +1,207 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunkenc
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// EncSHSCompressed identifies a CompressedHistoChunk: an EncSHS-encoded
+// HistoChunk wrapped in an outer, codec-selectable compression layer. It is
+// assigned the next value in the Encoding enum defined alongside EncSHS.
+const EncSHSCompressed = EncSHS + 1
+
+// Codec is a pluggable, outer (de)compression algorithm that can be layered
+// on top of a HistoChunk's usual dod/xor encoding. It trades CPU at append
+// and query time for a smaller on-disk/in-memory footprint on long-lived
+// chunks. Implementations must be safe for concurrent use, since a single
+// registered Codec is shared by every chunk that selects it.
+type Codec interface {
+	// Name is the identifier this codec is registered under, e.g. "snappy".
+	Name() string
+	// Encode appends the compressed form of src to dst and returns the
+	// extended slice.
+	Encode(dst, src []byte) []byte
+	// Decode appends the decompressed form of src to dst and returns the
+	// extended slice.
+	Decode(dst, src []byte) ([]byte, error)
+}
+
+// codecNone is the implicit, always-registered codec that leaves bytes
+// untouched. It is what every chunk gets unless an operator opts into one of
+// the registered codecs, so on-disk behavior is unchanged by default.
+type codecNone struct{}
+
+func (codecNone) Name() string { return "none" }
+
+func (codecNone) Encode(dst, src []byte) []byte { return append(dst, src...) }
+
+func (codecNone) Decode(dst, src []byte) ([]byte, error) { return append(dst, src...), nil }
+
+var codecs = map[string]Codec{"none": codecNone{}}
+
+// RegisterCodec makes a compression codec available to NewCompressedHistoChunk
+// and FromBytes under codec.Name(). Prometheus itself does not register any
+// codec by default beyond the implicit "none"; callers that want snappy,
+// zstd, lz4, gzip, etc. must import a package that registers one, typically
+// from an init function.
+//
+// The chunk's on-disk header records codec.Name() itself, not a
+// registration-derived ID, so codecs may be registered in any order across
+// binaries or versions without misdecoding chunks persisted by another one.
+//
+// RegisterCodec panics if called twice for the same name, or with the
+// reserved name "none".
+func RegisterCodec(codec Codec) {
+	name := codec.Name()
+	if name == "none" {
+		panic("chunkenc: codec name \"none\" is reserved")
+	}
+	if _, ok := codecs[name]; ok {
+		panic(fmt.Sprintf("chunkenc: codec %q already registered", name))
+	}
+	codecs[name] = codec
+}
+
+func codecByName(name string) (Codec, error) {
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("chunkenc: unknown compression codec %q", name)
+	}
+	return codec, nil
+}
+
+// CompressedHistoChunk wraps a HistoChunk with an optional outer compression
+// layer, selected per chunk via NewCompressedHistoChunk. Its wire format is:
+//
+//	varint   length of the codec name
+//	[]byte   codec name, e.g. "none" or "snappy"
+//	1 byte   trailing bit count of the decompressed HistoChunk's bstream
+//	varint   length of the decompressed HistoChunk bytes
+//	[]byte   codec-compressed HistoChunk bytes
+//
+// The codec name is persisted rather than a registration-order-derived ID,
+// so the mapping from header to Codec stays stable regardless of the order
+// codecs are registered in across binaries or versions. The trailing bit
+// count is persisted because histogram streams rarely end byte-aligned;
+// without it, resuming an Appender on a decompressed chunk would write
+// starting at the wrong bit offset and corrupt the chunk.
+//
+// Appends are written straight through to the inner, uncompressed
+// HistoChunk's bstream so the append path pays no codec overhead; the
+// contents are only (re-)compressed when Compact is called, which callers
+// are expected to do once a chunk is sealed.
+type CompressedHistoChunk struct {
+	codecName string
+	codec     Codec
+
+	inner *HistoChunk
+	raw   []byte // compressed form, refreshed by Compact
+}
+
+// NewCompressedHistoChunk returns a new, empty chunk that compresses its
+// contents with the named codec whenever Compact is called. Use "none" to
+// preserve the current, uncompressed behavior.
+func NewCompressedHistoChunk(codec string) (*CompressedHistoChunk, error) {
+	c, err := codecByName(codec)
+	if err != nil {
+		return nil, err
+	}
+	return &CompressedHistoChunk{
+		codecName: codec,
+		codec:     c,
+		inner:     NewHistoChunk(),
+	}, nil
+}
+
+// FromBytes parses the on-disk representation of a CompressedHistoChunk,
+// decompressing its payload so the chunk is immediately ready for appending
+// or iteration.
+func FromBytes(b []byte) (*CompressedHistoChunk, error) {
+	nameLen, m := binary.Uvarint(b)
+	if m <= 0 || uint64(m)+nameLen >= uint64(len(b)) {
+		return nil, fmt.Errorf("chunkenc: invalid compressed histo chunk header")
+	}
+	name := string(b[m : uint64(m)+nameLen])
+	codec, err := codecByName(name)
+	if err != nil {
+		return nil, err
+	}
+	rest := b[uint64(m)+nameLen:]
+
+	bitCount := rest[0]
+	n, k := binary.Uvarint(rest[1:])
+	if k <= 0 {
+		return nil, fmt.Errorf("chunkenc: invalid compressed histo chunk header")
+	}
+	dst, err := codec.Decode(make([]byte, 0, n), rest[1+k:])
+	if err != nil {
+		return nil, fmt.Errorf("chunkenc: decoding compressed histo chunk: %w", err)
+	}
+	return &CompressedHistoChunk{
+		codecName: name,
+		codec:     codec,
+		inner:     &HistoChunk{b: bstream{stream: dst, count: bitCount}},
+	}, nil
+}
+
+// Encoding returns the encoding type.
+func (c *CompressedHistoChunk) Encoding() Encoding {
+	return EncSHSCompressed
+}
+
+// Bytes returns the compressed, on-disk representation of the chunk. It
+// (re-)compresses the current contents first via Compact.
+func (c *CompressedHistoChunk) Bytes() []byte {
+	c.Compact()
+	return c.raw
+}
+
+// NumSamples returns the number of samples in the chunk.
+func (c *CompressedHistoChunk) NumSamples() int {
+	return c.inner.NumSamples()
+}
+
+// Compact (re-)compresses the chunk's current, decompressed contents. It is
+// idempotent; calling it without having appended anything since the last
+// call just redoes the same work.
+func (c *CompressedHistoChunk) Compact() {
+	c.inner.Compact()
+	raw := c.inner.Bytes()
+	bitCount := c.inner.b.count
+
+	var nameLenBuf, lenBuf [binary.MaxVarintLen64]byte
+	nn := binary.PutUvarint(nameLenBuf[:], uint64(len(c.codecName)))
+	n := binary.PutUvarint(lenBuf[:], uint64(len(raw)))
+
+	buf := make([]byte, 0, nn+len(c.codecName)+1+n+len(raw))
+	buf = append(buf, nameLenBuf[:nn]...)
+	buf = append(buf, c.codecName...)
+	buf = append(buf, bitCount)
+	buf = append(buf, lenBuf[:n]...)
+	c.raw = c.codec.Encode(buf, raw)
+}
+
+// Appender implements the Chunk interface. The returned Appender writes
+// through to the chunk's uncompressed inner HistoChunk.
+func (c *CompressedHistoChunk) Appender() (Appender, error) {
+	return c.inner.Appender()
+}
+
+// Iterator implements the Chunk interface, iterating the decompressed
+// samples held by the inner HistoChunk.
+func (c *CompressedHistoChunk) Iterator(it Iterator) Iterator {
+	return c.inner.Iterator(it)
+}
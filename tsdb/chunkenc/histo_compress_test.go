@@ -0,0 +1,100 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunkenc
+
+import "testing"
+
+// rleCodec is a minimal run-length encoder, registered only so
+// BenchmarkCompressedHistoChunk has a second codec to compare "none"
+// against without pulling in a real compression library.
+type rleCodec struct{}
+
+func (rleCodec) Name() string { return "test-rle" }
+
+func (rleCodec) Encode(dst, src []byte) []byte {
+	for i := 0; i < len(src); {
+		j := i + 1
+		for j < len(src) && j-i < 255 && src[j] == src[i] {
+			j++
+		}
+		dst = append(dst, byte(j-i), src[i])
+		i = j
+	}
+	return dst
+}
+
+func (rleCodec) Decode(dst, src []byte) ([]byte, error) {
+	for i := 0; i+1 < len(src); i += 2 {
+		n, v := src[i], src[i+1]
+		for j := byte(0); j < n; j++ {
+			dst = append(dst, v)
+		}
+	}
+	return dst, nil
+}
+
+func init() {
+	RegisterCodec(rleCodec{})
+}
+
+// churnLevels pairs a label with the number of bucket-layout growth events
+// growingHistograms spreads across its sample run, i.e. how often a chunk's
+// bucket set changes shape.
+var churnLevels = []struct {
+	name          string
+	interjections int
+}{
+	{"low-churn", 2},
+	{"high-churn", 30},
+}
+
+func compressedChunkFor(b *testing.B, codec string, interjections int) *CompressedHistoChunk {
+	b.Helper()
+	hs := growingHistograms(200, interjections)
+	c, err := NewCompressedHistoChunk(codec)
+	if err != nil {
+		b.Fatalf("NewCompressedHistoChunk: %s", err)
+	}
+	app, err := c.Appender()
+	if err != nil {
+		b.Fatalf("Appender: %s", err)
+	}
+	ha := app.(*histoAppender)
+	for i, h := range hs {
+		ha.AppendHistogram(int64(i), h)
+	}
+	return c
+}
+
+// BenchmarkCompressedHistoChunk compares decode speed and compressed size
+// across registered codecs, on synthetic sparse-histogram chunks with
+// varying bucket churn.
+func BenchmarkCompressedHistoChunk(b *testing.B) {
+	for _, codec := range []string{"none", "test-rle"} {
+		for _, churn := range churnLevels {
+			b.Run(codec+"/"+churn.name, func(b *testing.B) {
+				c := compressedChunkFor(b, codec, churn.interjections)
+				raw := c.Bytes()
+				b.ReportMetric(float64(len(raw)), "bytes/chunk")
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := FromBytes(raw); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunkenc
+
+import "testing"
+
+// TestHistoIteratorPoolZeroAlloc checks that, once the pooled iterator's
+// bucket slices have grown to accommodate the widest chunk seen, acquiring
+// and releasing it via GetHistoIterator/PutHistoIterator and iterating
+// chunks of varying bucket cardinality allocates nothing.
+func TestHistoIteratorPoolZeroAlloc(t *testing.T) {
+	var chunks []*HistoChunk
+	for _, n := range []int{2, 8, 32, 3, 16} {
+		c := NewHistoChunk()
+		app, err := c.Appender()
+		if err != nil {
+			t.Fatalf("Appender: %s", err)
+		}
+		ha := app.(*histoAppender)
+		h := histWithBuckets(0, 0, n, n)
+		for i := 0; i < 5; i++ {
+			if !ha.AppendHistogram(int64(i), h) {
+				t.Fatalf("bucket count %d: sample %d unexpectedly required a new chunk", n, i)
+			}
+		}
+		chunks = append(chunks, c)
+	}
+
+	run := func() {
+		for _, c := range chunks {
+			it := c.Iterator(GetHistoIterator()).(*histoIterator)
+			for it.Next() {
+				it.AtHistogram()
+			}
+			PutHistoIterator(it)
+		}
+	}
+
+	// Warm up so the pooled iterator's bucket slices grow to fit the widest
+	// chunk and the pool settles on reusing a single instance before
+	// measuring.
+	for i := 0; i < 10; i++ {
+		run()
+	}
+
+	allocs := testing.AllocsPerRun(10000, run)
+	if allocs != 0 {
+		t.Fatalf("GetHistoIterator/PutHistoIterator + iteration allocated %v times per run after warmup, want 0", allocs)
+	}
+}
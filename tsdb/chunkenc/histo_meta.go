@@ -0,0 +1,211 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunkenc
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/prometheus/prometheus/pkg/histogram"
+)
+
+// writeHistoChunkMeta writes the metadata shared by all samples in a
+// HistoChunk: the bucket schema, the zero threshold, and the positive and
+// negative bucket spans. It is only ever called once, by the first sample
+// appended to a chunk.
+func writeHistoChunkMeta(b *bstream, schema int32, zeroThreshold float64, posSpans, negSpans []histogram.Span) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	putVarint(b, buf, int64(schema))
+	b.writeBits(math.Float64bits(zeroThreshold), 64)
+	writeHistoChunkMetaSpans(b, buf, posSpans)
+	writeHistoChunkMetaSpans(b, buf, negSpans)
+}
+
+func writeHistoChunkMetaSpans(b *bstream, buf []byte, spans []histogram.Span) {
+	putVarint(b, buf, int64(len(spans)))
+	for _, s := range spans {
+		putVarint(b, buf, int64(s.Offset))
+		putUvarint(b, buf, uint64(s.Length))
+	}
+}
+
+// readHistoChunkMeta is the counterpart to writeHistoChunkMeta.
+func readHistoChunkMeta(b *bstreamReader) (int32, float64, []histogram.Span, []histogram.Span, error) {
+	v, err := binary.ReadVarint(b)
+	if err != nil {
+		return 0, 0, nil, nil, err
+	}
+	schema := int32(v)
+
+	zt, err := b.readBits(64)
+	if err != nil {
+		return 0, 0, nil, nil, err
+	}
+	zeroThreshold := math.Float64frombits(zt)
+
+	posSpans, err := readHistoChunkMetaSpans(b)
+	if err != nil {
+		return 0, 0, nil, nil, err
+	}
+	negSpans, err := readHistoChunkMetaSpans(b)
+	if err != nil {
+		return 0, 0, nil, nil, err
+	}
+	return schema, zeroThreshold, posSpans, negSpans, nil
+}
+
+func readHistoChunkMetaSpans(b *bstreamReader) ([]histogram.Span, error) {
+	n, err := binary.ReadVarint(b)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	spans := make([]histogram.Span, n)
+	for i := range spans {
+		offset, err := binary.ReadVarint(b)
+		if err != nil {
+			return nil, err
+		}
+		length, err := binary.ReadUvarint(b)
+		if err != nil {
+			return nil, err
+		}
+		spans[i] = histogram.Span{Offset: int32(offset), Length: uint32(length)}
+	}
+	return spans, nil
+}
+
+// interjection describes a run of num consecutive new (so far zero-valued)
+// buckets that the new bucket layout introduced at pos, the index (in the
+// old, pre-interjection bucket slice) right before which they must be
+// spliced in.
+type interjection struct {
+	pos int
+	num int
+}
+
+// bucketIterator walks the absolute bucket indices described by a set of
+// spans, where each span's Offset is relative to the end of the previous
+// one (or to the origin, for the first span).
+type bucketIterator struct {
+	spans []histogram.Span
+	idx   int // index into spans; -1 before the first call to Next
+	cur   int // current absolute bucket index, valid once idx >= 0
+	left  int // buckets remaining in the current span, including cur
+}
+
+func newBucketIterator(spans []histogram.Span) *bucketIterator {
+	return &bucketIterator{spans: spans, idx: -1, cur: -1}
+}
+
+// Next returns the next absolute bucket index, or false if there are none
+// left.
+func (b *bucketIterator) Next() (int, bool) {
+	if b.left > 1 {
+		b.left--
+		b.cur++
+		return b.cur, true
+	}
+	for {
+		b.idx++
+		if b.idx >= len(b.spans) {
+			return 0, false
+		}
+		span := b.spans[b.idx]
+		if span.Length == 0 {
+			b.cur += int(span.Offset)
+			continue
+		}
+		b.cur += int(span.Offset) + 1
+		b.left = int(span.Length)
+		return b.cur, true
+	}
+}
+
+// compareSpans diffs the old bucket layout a against the new layout b and
+// reports what's needed to reconcile an old bucket slice to the new layout.
+// interjections describes the runs of new buckets that must be spliced in as
+// zeroes. deletions lists the absolute bucket indices present in a but
+// missing from b. ok is true iff deletions is empty, i.e. a's populated
+// buckets are a subset of b's and the layout change can be accommodated by
+// interjecting zeroes alone; when ok is false, the chunk can't represent the
+// new sample in place and must be rolled into a new one instead.
+func compareSpans(a, b []histogram.Span) (interjections []interjection, deletions []int, ok bool) {
+	ai := newBucketIterator(a)
+	bi := newBucketIterator(b)
+
+	oldIdx := 0
+	av, aok := ai.Next()
+	bv, bok := bi.Next()
+	for aok {
+		switch {
+		case !bok || av < bv:
+			// a has a bucket that b doesn't: it would be lost.
+			deletions = append(deletions, av)
+			av, aok = ai.Next()
+			oldIdx++
+		case av == bv:
+			av, aok = ai.Next()
+			bv, bok = bi.Next()
+			oldIdx++
+		default: // av > bv
+			num := 0
+			for bok && bv < av {
+				num++
+				bv, bok = bi.Next()
+			}
+			interjections = append(interjections, interjection{pos: oldIdx, num: num})
+		}
+	}
+	// Whatever is left of b lies past a's last bucket.
+	num := 0
+	for bok {
+		num++
+		_, bok = bi.Next()
+	}
+	if num > 0 {
+		interjections = append(interjections, interjection{pos: oldIdx, num: num})
+	}
+	return interjections, deletions, len(deletions) == 0
+}
+
+// interject splices len(interjections) runs of zero-valued buckets into
+// scratch (which must be sized for the post-interjection bucket count),
+// copying the buckets that already existed in old verbatim in between. It
+// returns the populated portion of scratch.
+func interject(old, scratch []int64, interjections []interjection) []int64 {
+	oldIdx, newIdx, iIdx := 0, 0, 0
+	for oldIdx < len(old) {
+		if iIdx < len(interjections) && interjections[iIdx].pos == oldIdx {
+			for i := 0; i < interjections[iIdx].num; i++ {
+				scratch[newIdx] = 0
+				newIdx++
+			}
+			iIdx++
+			continue
+		}
+		scratch[newIdx] = old[oldIdx]
+		oldIdx++
+		newIdx++
+	}
+	for ; iIdx < len(interjections); iIdx++ {
+		for i := 0; i < interjections[iIdx].num; i++ {
+			scratch[newIdx] = 0
+			newIdx++
+		}
+	}
+	return scratch[:newIdx]
+}
@@ -0,0 +1,244 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunkenc
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/pkg/histogram"
+)
+
+// appendOrRollAll feeds hs through AppendOrRoll in sequence, starting from a
+// single empty head chunk, and returns every chunk produced along with the
+// samples each one ended up holding.
+func appendOrRollAll(t *testing.T, hs []histogram.SparseHistogram) (chunks []*HistoChunk, samplesByChunk [][]histogram.SparseHistogram) {
+	t.Helper()
+	head := NewHistoChunk()
+	chunks = append(chunks, head)
+	samplesByChunk = append(samplesByChunk, nil)
+
+	for i, h := range hs {
+		cur, next := AppendOrRoll(head, int64(i), h)
+		if next != nil {
+			head = next
+			chunks = append(chunks, head)
+			samplesByChunk = append(samplesByChunk, nil)
+		} else if cur != head {
+			t.Fatalf("sample %d: AppendOrRoll returned an unexpected cur chunk", i)
+		}
+		last := len(samplesByChunk) - 1
+		samplesByChunk[last] = append(samplesByChunk[last], h)
+	}
+	return chunks, samplesByChunk
+}
+
+// decodeChunk reads back every histogram a chunk holds via its iterator.
+func decodeChunk(t *testing.T, c *HistoChunk) []histogram.SparseHistogram {
+	t.Helper()
+	it := c.iterator(nil)
+	var got []histogram.SparseHistogram
+	for it.Next() {
+		_, h := it.AtHistogram()
+		// The bucket slices are the iterator's own and the next Next
+		// overwrites them in place, so keep copies.
+		h.PositiveBuckets = append([]int64(nil), h.PositiveBuckets...)
+		h.NegativeBuckets = append([]int64(nil), h.NegativeBuckets...)
+		got = append(got, h)
+	}
+	if it.Err() != nil {
+		t.Fatalf("iterating decoded chunk: %s", it.Err())
+	}
+	return got
+}
+
+func sameBuckets(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sameSpans(a, b []histogram.Span) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func assertHistogramsEqual(t *testing.T, i int, want, got histogram.SparseHistogram) {
+	t.Helper()
+	if want.Count != got.Count || want.ZeroCount != got.ZeroCount || want.Sum != got.Sum ||
+		want.Schema != got.Schema || want.ZeroThreshold != got.ZeroThreshold ||
+		!sameSpans(want.PositiveSpans, got.PositiveSpans) || !sameSpans(want.NegativeSpans, got.NegativeSpans) ||
+		!sameBuckets(want.PositiveBuckets, got.PositiveBuckets) || !sameBuckets(want.NegativeBuckets, got.NegativeBuckets) {
+		t.Fatalf("sample %d: decoded histogram does not match input\nwant: %+v\ngot:  %+v", i, want, got)
+	}
+}
+
+func histWithBuckets(schema int32, zeroThreshold float64, numPos, numNeg int) histogram.SparseHistogram {
+	posBuckets := make([]int64, numPos)
+	negBuckets := make([]int64, numNeg)
+	for i := range posBuckets {
+		posBuckets[i] = int64(i + 1)
+	}
+	for i := range negBuckets {
+		negBuckets[i] = int64(i + 1)
+	}
+	return histogram.SparseHistogram{
+		Count:           1,
+		ZeroCount:       1,
+		Sum:             1,
+		Schema:          schema,
+		ZeroThreshold:   zeroThreshold,
+		PositiveSpans:   []histogram.Span{{Offset: 0, Length: uint32(numPos)}},
+		NegativeSpans:   []histogram.Span{{Offset: 0, Length: uint32(numNeg)}},
+		PositiveBuckets: posBuckets,
+		NegativeBuckets: negBuckets,
+	}
+}
+
+// TestAppendOrRollGrowing checks that a run of samples whose bucket set only
+// ever grows stays in a single chunk, and that every sample round-trips
+// through encode/decode unchanged apart from being widened to the chunk's
+// final bucket layout, with zeroes in the buckets it did not have.
+func TestAppendOrRollGrowing(t *testing.T) {
+	hs := growingHistograms(30, 6)
+	for i := range hs {
+		hs[i].ZeroThreshold = 0.001
+	}
+
+	chunks, samplesByChunk := appendOrRollAll(t, hs)
+	if len(chunks) != 1 {
+		t.Fatalf("growing-only run unexpectedly rolled into %d chunks", len(chunks))
+	}
+
+	got := decodeChunk(t, chunks[0])
+	if len(got) != len(hs) {
+		t.Fatalf("decoded %d samples, want %d", len(got), len(hs))
+	}
+	last := hs[len(hs)-1]
+	for i, want := range samplesByChunk[0] {
+		posBuckets := make([]int64, len(last.PositiveBuckets))
+		copy(posBuckets, want.PositiveBuckets)
+		negBuckets := make([]int64, len(last.NegativeBuckets))
+		copy(negBuckets, want.NegativeBuckets)
+		want.PositiveSpans, want.NegativeSpans = last.PositiveSpans, last.NegativeSpans
+		want.PositiveBuckets, want.NegativeBuckets = posBuckets, negBuckets
+		assertHistogramsEqual(t, i, want, got[i])
+	}
+
+	schema, zeroThreshold, _, _, err := chunks[0].Meta()
+	if err != nil {
+		t.Fatalf("Meta: %s", err)
+	}
+	if schema != hs[0].Schema || zeroThreshold != hs[0].ZeroThreshold {
+		t.Fatalf("Meta() = (%v, %v), want (%v, %v)", schema, zeroThreshold, hs[0].Schema, hs[0].ZeroThreshold)
+	}
+}
+
+// TestAppendOrRollShrinking checks that a sample whose bucket set loses
+// buckets the chunk can't drop in place rolls into a new chunk, and that
+// both the sealed and the new chunk decode back to exactly the samples they
+// were given.
+func TestAppendOrRollShrinking(t *testing.T) {
+	hs := []histogram.SparseHistogram{
+		histWithBuckets(0, 0, 4, 4),
+		histWithBuckets(0, 0, 4, 4),
+		histWithBuckets(0, 0, 2, 4), // drops two positive buckets: not appendable in place
+		histWithBuckets(0, 0, 2, 4),
+	}
+
+	chunks, samplesByChunk := appendOrRollAll(t, hs)
+	if len(chunks) != 2 {
+		t.Fatalf("shrinking run produced %d chunks, want 2", len(chunks))
+	}
+	if len(samplesByChunk[0]) != 2 || len(samplesByChunk[1]) != 2 {
+		t.Fatalf("unexpected chunk split: %v", samplesByChunk)
+	}
+
+	for ci, chunk := range chunks {
+		got := decodeChunk(t, chunk)
+		if len(got) != len(samplesByChunk[ci]) {
+			t.Fatalf("chunk %d: decoded %d samples, want %d", ci, len(got), len(samplesByChunk[ci]))
+		}
+		for i, want := range samplesByChunk[ci] {
+			assertHistogramsEqual(t, i, want, got[i])
+		}
+	}
+}
+
+// TestAppendOrRollZeroThresholdChange checks that a changed zero threshold
+// rolls into a new chunk, and that each chunk's own zero threshold round
+// trips through Meta().
+func TestAppendOrRollZeroThresholdChange(t *testing.T) {
+	hs := []histogram.SparseHistogram{
+		histWithBuckets(0, 0.001, 3, 3),
+		histWithBuckets(0, 0.001, 3, 3),
+		histWithBuckets(0, 0.002, 3, 3), // zero threshold changed: not appendable in place
+		histWithBuckets(0, 0.002, 3, 3),
+	}
+
+	chunks, samplesByChunk := appendOrRollAll(t, hs)
+	if len(chunks) != 2 {
+		t.Fatalf("zero-threshold change produced %d chunks, want 2", len(chunks))
+	}
+
+	for ci, chunk := range chunks {
+		got := decodeChunk(t, chunk)
+		for i, want := range samplesByChunk[ci] {
+			assertHistogramsEqual(t, i, want, got[i])
+		}
+
+		_, zeroThreshold, _, _, err := chunk.Meta()
+		if err != nil {
+			t.Fatalf("chunk %d: Meta: %s", ci, err)
+		}
+		if zeroThreshold != samplesByChunk[ci][0].ZeroThreshold {
+			t.Fatalf("chunk %d: Meta() zero threshold = %v, want %v", ci, zeroThreshold, samplesByChunk[ci][0].ZeroThreshold)
+		}
+	}
+}
+
+// TestAppendOrRollSchemaChange checks that a changed schema also forces a
+// roll, same as a zero threshold change.
+func TestAppendOrRollSchemaChange(t *testing.T) {
+	hs := []histogram.SparseHistogram{
+		histWithBuckets(0, 0, 3, 3),
+		histWithBuckets(1, 0, 3, 3), // schema changed: not appendable in place
+	}
+
+	chunks, _ := appendOrRollAll(t, hs)
+	if len(chunks) != 2 {
+		t.Fatalf("schema change produced %d chunks, want 2", len(chunks))
+	}
+	for ci, chunk := range chunks {
+		schema, _, _, _, err := chunk.Meta()
+		if err != nil {
+			t.Fatalf("chunk %d: Meta: %s", ci, err)
+		}
+		if schema != hs[ci].Schema {
+			t.Fatalf("chunk %d: Meta() schema = %v, want %v", ci, schema, hs[ci].Schema)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunkenc
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/pkg/histogram"
+)
+
+// naiveRecode is the decode-every-sample-and-re-append approach recode used
+// before this change, except that each sample gets its own bucket slices (the
+// appender keeps the previous sample's slices to compute deltas, so they must
+// not be overwritten by the next decode); kept here only so BenchmarkRecode
+// and TestRecodeMatchesNaive can compare against it.
+func naiveRecode(a *histoAppender, posInterjections, negInterjections []interjection, posSpans, negSpans []histogram.Span) {
+	it := newHistoIterator(a.b.bytes())
+	app, err := NewHistoChunk().Appender()
+	if err != nil {
+		panic(err)
+	}
+	numPosBuckets, numNegBuckets := countSpans(posSpans), countSpans(negSpans)
+
+	for it.Next() {
+		tOld, hOld := it.AtHistogram()
+		hOld.PositiveSpans, hOld.NegativeSpans = posSpans, negSpans
+		hOld.PositiveBuckets = recodeBuckets(hOld.PositiveBuckets, numPosBuckets, posInterjections)
+		hOld.NegativeBuckets = recodeBuckets(hOld.NegativeBuckets, numNegBuckets, negInterjections)
+		app.AppendHistogram(tOld, hOld)
+	}
+
+	app2 := app.(*histoAppender)
+	*a.b = *app2.b
+	a.posSpans, a.negSpans = posSpans, negSpans
+	a.posbuckets, a.negbuckets = app2.posbuckets, app2.negbuckets
+	a.posbucketsDelta, a.negbucketsDelta = app2.posbucketsDelta, app2.negbucketsDelta
+}
+
+// growingHistograms builds n histogram samples, the bucket layout growing
+// every n/(interjections+1) samples, interjections times in all (fewer only
+// if n <= interjections), so that AppendHistogram triggers interjections
+// recodes. Each growth event adds one positive bucket.
+// The negative side only grows on every second growth event, so the other
+// half of the growth events touch just one side -- the case that used to
+// alias the other side's bucket slice.
+func growingHistograms(n, interjections int) []histogram.SparseHistogram {
+	step := n / (interjections + 1)
+	if step == 0 {
+		step = 1
+	}
+	hs := make([]histogram.SparseHistogram, 0, n)
+	numPos, numNeg := 2, 2
+	growthEvents := 0
+	for i := 0; i < n; i++ {
+		if i > 0 && i%step == 0 && growthEvents < interjections {
+			growthEvents++
+			numPos++
+			if growthEvents%2 == 0 {
+				numNeg++
+			}
+		}
+		posBuckets := make([]int64, numPos)
+		negBuckets := make([]int64, numNeg)
+		for j := range posBuckets {
+			posBuckets[j] = int64(j + 1)
+		}
+		for j := range negBuckets {
+			negBuckets[j] = int64(j + 1)
+		}
+		hs = append(hs, histogram.SparseHistogram{
+			Count:           uint64(i + 1),
+			ZeroCount:       uint64(i),
+			Sum:             float64(i) * 1.5,
+			Schema:          0,
+			PositiveSpans:   []histogram.Span{{Offset: 0, Length: uint32(numPos)}},
+			NegativeSpans:   []histogram.Span{{Offset: 0, Length: uint32(numNeg)}},
+			PositiveBuckets: posBuckets,
+			NegativeBuckets: negBuckets,
+		})
+	}
+	return hs
+}
+
+func appendAll(t *testing.T, hs []histogram.SparseHistogram) *HistoChunk {
+	t.Helper()
+	c := NewHistoChunk()
+	app, err := c.Appender()
+	if err != nil {
+		t.Fatalf("Appender: %s", err)
+	}
+	ha := app.(*histoAppender)
+	for i, h := range hs {
+		if !ha.AppendHistogram(int64(i), h) {
+			t.Fatalf("sample %d unexpectedly required a new chunk", i)
+		}
+	}
+	return c
+}
+
+// TestRecodeMatchesFreshAppend checks that a chunk built incrementally
+// (triggering recode whenever the bucket set grows, including growth events
+// that touch only one side) is byte-for-byte identical to a chunk built by
+// re-appending the same samples from scratch, already reshaped to the final,
+// widest bucket layout. This is also a regression test for the slice
+// aliasing bug where the side that wasn't interjected ended up sharing the
+// iterator's backing array, freezing its decoded values at the first
+// sample.
+func TestRecodeMatchesFreshAppend(t *testing.T) {
+	hs := growingHistograms(40, 8)
+
+	got := appendAll(t, hs)
+
+	finalPosSpans := hs[len(hs)-1].PositiveSpans
+	finalNegSpans := hs[len(hs)-1].NegativeSpans
+	reshaped := make([]histogram.SparseHistogram, len(hs))
+	for i, h := range hs {
+		posBuckets := make([]int64, countSpans(finalPosSpans))
+		copy(posBuckets, h.PositiveBuckets)
+		negBuckets := make([]int64, countSpans(finalNegSpans))
+		copy(negBuckets, h.NegativeBuckets)
+		h.PositiveSpans, h.NegativeSpans = finalPosSpans, finalNegSpans
+		h.PositiveBuckets, h.NegativeBuckets = posBuckets, negBuckets
+		reshaped[i] = h
+	}
+	want := appendAll(t, reshaped)
+
+	if string(got.Bytes()) != string(want.Bytes()) {
+		t.Fatalf("recoded chunk bytes differ from a fresh, pre-widened append:\ngot:  %x\nwant: %x", got.Bytes(), want.Bytes())
+	}
+}
+
+// TestRecodeMatchesNaive compares the optimized recode path against the
+// naive decode/re-append implementation it replaced, on a chunk shaped like
+// the request's benchmark scenario (120 samples, 8 interjection events).
+func TestRecodeMatchesNaive(t *testing.T) {
+	hs := growingHistograms(120, 8)
+
+	got := appendAll(t, hs)
+
+	c := NewHistoChunk()
+	app, err := c.Appender()
+	if err != nil {
+		t.Fatalf("Appender: %s", err)
+	}
+	ha := app.(*histoAppender)
+	for i, h := range hs {
+		if i > 0 {
+			posInterjections, negInterjections, ok := ha.appendable(h)
+			if !ok {
+				t.Fatalf("sample %d: unexpectedly not appendable", i)
+			}
+			if len(posInterjections) > 0 || len(negInterjections) > 0 {
+				naiveRecode(ha, posInterjections, negInterjections, h.PositiveSpans, h.NegativeSpans)
+			}
+		}
+		if !ha.AppendHistogram(int64(i), h) {
+			t.Fatalf("sample %d unexpectedly required a new chunk", i)
+		}
+	}
+
+	if string(got.Bytes()) != string(c.Bytes()) {
+		t.Fatalf("optimized recode output differs from naive recode output")
+	}
+}
+
+// BenchmarkRecode compares the optimized, struct-free recode against the
+// naive decode/rebuild-SparseHistogram/AppendHistogram approach it replaced,
+// on a 120-sample chunk with 8 interjection events, as requested.
+func BenchmarkRecode(b *testing.B) {
+	hs := growingHistograms(120, 8)
+
+	b.Run("optimized", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			c := NewHistoChunk()
+			app, err := c.Appender()
+			if err != nil {
+				b.Fatal(err)
+			}
+			ha := app.(*histoAppender)
+			for j, h := range hs {
+				ha.AppendHistogram(int64(j), h)
+			}
+		}
+	})
+
+	b.Run("naive", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			c := NewHistoChunk()
+			app, err := c.Appender()
+			if err != nil {
+				b.Fatal(err)
+			}
+			ha := app.(*histoAppender)
+			for j, h := range hs {
+				if j > 0 {
+					posInterjections, negInterjections, ok := ha.appendable(h)
+					if ok && (len(posInterjections) > 0 || len(negInterjections) > 0) {
+						naiveRecode(ha, posInterjections, negInterjections, h.PositiveSpans, h.NegativeSpans)
+					}
+				}
+				ha.AppendHistogram(int64(j), h)
+			}
+		}
+	})
+}